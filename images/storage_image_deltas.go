@@ -0,0 +1,343 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package images
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Database
+const (
+	CollectionImageDeltas = "image_deltas"
+)
+
+// Database KEYS
+const (
+	StorageKeyImageDeltaFromImageID = "from_image_id"
+	StorageKeyImageDeltaToImageID   = "to_image_id"
+)
+
+// Indexes
+const (
+	IndexImageDeltaFromToStr = "imageDeltaFromToIndex"
+)
+
+// DeltaAlgorithm identifies the binary diff algorithm a patch was
+// produced with.
+type DeltaAlgorithm string
+
+const (
+	AlgorithmBsdiff  DeltaAlgorithm = "bsdiff"
+	AlgorithmXdelta3 DeltaAlgorithm = "xdelta3"
+
+	// DefaultDeltaSizeThreshold is the image size, in bytes, above which
+	// EnsureDelta picks xdelta3 instead of bsdiff - bsdiff's in-memory
+	// suffix sort does not scale well past a couple of GB.
+	DefaultDeltaSizeThreshold int64 = 2 << 30 // 2GB
+)
+
+// Errors
+var (
+	ErrStorageInvalidDelta    = errors.New("Invalid image delta")
+	ErrDeltaSourceNotFound    = errors.New("Source image not found")
+	ErrDeltaTargetNotFound    = errors.New("Target image not found")
+	ErrDeltaGeneratorNotWired = errors.New("No DeltaGenerator configured, see SetDeltaGenerator")
+)
+
+// ImageDelta describes a binary patch that turns fromImageId's content
+// into toImageId's content, so a device already running fromImageId can
+// download it instead of the full toImageId artifact.
+type ImageDelta struct {
+	FromImageID     string         `json:"from_image_id" bson:"from_image_id"`
+	ToImageID       string         `json:"to_image_id" bson:"to_image_id"`
+	PatchSize       int64          `json:"patch_size" bson:"patch_size"`
+	PatchChecksum   string         `json:"patch_checksum" bson:"patch_checksum"`
+	PatchStorageRef string         `json:"patch_storage_ref" bson:"patch_storage_ref"`
+	Algorithm       DeltaAlgorithm `json:"algorithm" bson:"algorithm"`
+	SourceChecksum  string         `json:"source_checksum" bson:"source_checksum"`
+	TargetChecksum  string         `json:"target_checksum" bson:"target_checksum"`
+	CreatedAt       time.Time      `json:"created_at" bson:"created_at"`
+}
+
+// BlobStorage is the existing content-addressable blob store the
+// service already keeps full image artifacts in. DeltaGenerator reads
+// source/target payloads through it and writes the resulting patch back
+// to it, rather than introducing a separate store just for patches.
+type BlobStorage interface {
+	Get(ctx context.Context, ref string) (io.ReadCloser, error)
+	Put(ctx context.Context, payload io.Reader) (ref string, err error)
+}
+
+// Differ produces a binary patch that turns from into to, writing it to
+// patch as it streams both inputs.
+type Differ interface {
+	Diff(ctx context.Context, from, to io.Reader, patch io.Writer) error
+}
+
+// DeltaGenerator computes and persists ImageDelta patches on demand, in
+// the background, so the request that discovers a delta is missing does
+// not block on the differ.
+type DeltaGenerator struct {
+	storage *SoftwareImagesStorage
+	blobs   BlobStorage
+	differs map[DeltaAlgorithm]Differ
+
+	// sizeThreshold is the image size above which xdelta3 is used
+	// instead of bsdiff. Defaults to DefaultDeltaSizeThreshold.
+	sizeThreshold int64
+
+	// pending tracks (fromID, toID) pairs currently being computed, so
+	// Dispatch does not start the same job twice while it is in flight.
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+// NewDeltaGenerator creates a DeltaGenerator that reads/writes artifacts
+// through blobs and dispatches to the given differs, keyed by algorithm.
+func NewDeltaGenerator(storage *SoftwareImagesStorage, blobs BlobStorage, differs map[DeltaAlgorithm]Differ) *DeltaGenerator {
+
+	return &DeltaGenerator{
+		storage:       storage,
+		blobs:         blobs,
+		differs:       differs,
+		sizeThreshold: DefaultDeltaSizeThreshold,
+		pending:       make(map[string]bool),
+	}
+}
+
+// IndexDeltaStorage sets the unique index backing FindDelta/insertDelta,
+// so concurrent EnsureDelta calls for the same (fromID, toID) pair -
+// across processes, or across a restart mid-flight, which DeltaGenerator's
+// in-process pending map cannot dedup - can race to insert but never end
+// up with two deltas for the same pair.
+func (i *SoftwareImagesStorage) IndexDeltaStorage() error {
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	fromToIndex := mgo.Index{
+		Key:        []string{StorageKeyImageDeltaFromImageID, StorageKeyImageDeltaToImageID},
+		Unique:     true,
+		Name:       IndexImageDeltaFromToStr,
+		Background: false,
+	}
+
+	return session.DB(DatabaseName).C(CollectionImageDeltas).EnsureIndex(fromToIndex)
+}
+
+// FindDelta looks up an already computed delta between fromID and toID.
+// Returns nil, nil if none has been generated yet.
+func (i *SoftwareImagesStorage) FindDelta(fromID, toID string) (*ImageDelta, error) {
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	query := bson.M{
+		StorageKeyImageDeltaFromImageID: fromID,
+		StorageKeyImageDeltaToImageID:   toID,
+	}
+
+	var delta ImageDelta
+	err := session.DB(DatabaseName).C(CollectionImageDeltas).Find(query).One(&delta)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &delta, nil
+}
+
+// insertDelta persists a freshly computed delta, used by DeltaGenerator.
+func (i *SoftwareImagesStorage) insertDelta(delta *ImageDelta) error {
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	return session.DB(DatabaseName).C(CollectionImageDeltas).Insert(delta)
+}
+
+// SetDeltaGenerator wires the DeltaGenerator EnsureDelta dispatches
+// background patch computation to.
+func (i *SoftwareImagesStorage) SetDeltaGenerator(gen *DeltaGenerator) {
+	i.deltaGenerator = gen
+}
+
+// EnsureDelta makes sure a patch from fromID to toID exists, dispatching
+// a background job to compute and store one if it does not. Safe to
+// call repeatedly; an already computed delta is left untouched, and a
+// delta already being computed is not recomputed. Returns before the
+// patch is necessarily ready - poll FindDelta to learn when it is.
+func (i *SoftwareImagesStorage) EnsureDelta(fromID, toID string) error {
+
+	existing, err := i.FindDelta(fromID, toID)
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return nil
+	}
+
+	if i.deltaGenerator == nil {
+		return ErrDeltaGeneratorNotWired
+	}
+
+	i.deltaGenerator.Dispatch(fromID, toID)
+
+	return nil
+}
+
+// pendingKey identifies a (fromID, toID) pair in DeltaGenerator.pending.
+func pendingKey(fromID, toID string) string {
+	return fromID + "->" + toID
+}
+
+// Dispatch computes a delta from fromID to toID in the background and
+// persists it once done, logging nothing and surfacing no error on
+// failure - a later EnsureDelta call for the same pair will simply
+// dispatch it again. A pair already in flight is not dispatched twice.
+func (g *DeltaGenerator) Dispatch(fromID, toID string) {
+
+	key := pendingKey(fromID, toID)
+
+	g.mu.Lock()
+	if g.pending[key] {
+		g.mu.Unlock()
+		return
+	}
+	g.pending[key] = true
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			g.mu.Lock()
+			delete(g.pending, key)
+			g.mu.Unlock()
+		}()
+
+		delta, err := g.Generate(context.Background(), fromID, toID)
+		if err != nil {
+			return
+		}
+
+		g.storage.insertDelta(delta)
+	}()
+}
+
+// Generate computes a binary patch from fromID's image to toID's image,
+// stores it via BlobStorage and returns the resulting ImageDelta. It
+// does not consult or update FindDelta/EnsureDelta's cache; callers
+// normally go through SoftwareImagesStorage.EnsureDelta instead, which
+// dispatches it via Dispatch.
+func (g *DeltaGenerator) Generate(ctx context.Context, fromID, toID string) (*ImageDelta, error) {
+
+	from, err := g.storage.FindByID(fromID)
+	if err != nil {
+		return nil, err
+	}
+	if from == nil {
+		return nil, ErrDeltaSourceNotFound
+	}
+
+	to, err := g.storage.FindByID(toID)
+	if err != nil {
+		return nil, err
+	}
+	if to == nil {
+		return nil, ErrDeltaTargetNotFound
+	}
+
+	fromBlob, err := g.blobs.Get(ctx, fromID)
+	if err != nil {
+		return nil, err
+	}
+	defer fromBlob.Close()
+
+	toBlob, err := g.blobs.Get(ctx, toID)
+	if err != nil {
+		return nil, err
+	}
+	defer toBlob.Close()
+
+	algorithm := g.algorithmFor(to)
+	differ, ok := g.differs[algorithm]
+	if !ok {
+		return nil, errors.Errorf("no differ registered for algorithm %q", algorithm)
+	}
+
+	fromHash := sha256.New()
+	toHash := sha256.New()
+	patchHash := sha256.New()
+	var patchSize countingWriter
+
+	// Stream the patch straight into the blob store as the differ
+	// produces it, rather than buffering a potentially multi-GB patch
+	// in memory.
+	pr, pw := io.Pipe()
+	go func() {
+		err := differ.Diff(ctx, io.TeeReader(fromBlob, fromHash), io.TeeReader(toBlob, toHash), pw)
+		pw.CloseWithError(err)
+	}()
+
+	ref, err := g.blobs.Put(ctx, io.TeeReader(pr, io.MultiWriter(patchHash, &patchSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageDelta{
+		FromImageID:     fromID,
+		ToImageID:       toID,
+		PatchSize:       patchSize.n,
+		PatchChecksum:   hex.EncodeToString(patchHash.Sum(nil)),
+		PatchStorageRef: ref,
+		Algorithm:       algorithm,
+		SourceChecksum:  hex.EncodeToString(fromHash.Sum(nil)),
+		TargetChecksum:  hex.EncodeToString(toHash.Sum(nil)),
+		CreatedAt:       time.Now(),
+	}, nil
+}
+
+// algorithmFor picks bsdiff for images under sizeThreshold and xdelta3
+// above it, per DefaultDeltaSizeThreshold.
+func (g *DeltaGenerator) algorithmFor(image *SoftwareImage) DeltaAlgorithm {
+
+	if image.Size() > g.sizeThreshold {
+		return AlgorithmXdelta3
+	}
+
+	return AlgorithmBsdiff
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
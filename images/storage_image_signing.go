@@ -0,0 +1,281 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package images
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SignatureAlgorithm identifies the cryptographic scheme a signature was
+// produced with.
+type SignatureAlgorithm string
+
+const (
+	AlgorithmRSAPSSSHA256 SignatureAlgorithm = "rsa-pss-sha256"
+	AlgorithmEd25519      SignatureAlgorithm = "ed25519"
+	AlgorithmECDSAP256    SignatureAlgorithm = "ecdsa-p256"
+)
+
+// ImageSignature is a single signature over an image's content,
+// attached to SoftwareImage.Signatures.
+type ImageSignature struct {
+	KeyID     string             `json:"key_id" bson:"key_id"`
+	Algorithm SignatureAlgorithm `json:"algorithm" bson:"algorithm"`
+	Signature []byte             `json:"signature" bson:"signature"`
+	// X5C is an optional X.509 certificate chain, leaf first, backing
+	// KeyID - present when the signer authenticates through a cert
+	// chain rather than a bare key registered in CollectionSigningKeys.
+	X5C [][]byte `json:"x5c,omitempty" bson:"x5c,omitempty"`
+}
+
+// Signer produces an ImageSignature over the full image content.
+type Signer interface {
+	Sign(imageBytes io.Reader) (ImageSignature, error)
+}
+
+// Verifier checks that an ImageSignature on image matches payload.
+// Verify should return nil only if at least one of image's signatures
+// was produced by a trusted, non-revoked, currently valid key.
+type Verifier interface {
+	Verify(image *SoftwareImage, payload io.Reader) error
+}
+
+// Database
+const (
+	CollectionSigningKeys = "signing_keys"
+)
+
+// Database KEYS
+const (
+	StorageKeySigningKeyID = "key_id"
+)
+
+// Indexes
+const (
+	IndexUniqueSigningKeyIDStr = "uniqueSigningKeyIdIndex"
+)
+
+// Errors
+var (
+	ErrStorageInvalidSigningKey = errors.New("Invalid signing key")
+	ErrStorageUnsignedImage     = errors.New("Image has no signatures")
+	ErrStorageSignatureRejected = errors.New("Image signature rejected by all verifiers")
+)
+
+// SigningKey is a trust root or public key used to verify ImageSignatures.
+type SigningKey struct {
+	KeyID     string    `json:"key_id" bson:"key_id"`
+	PEM       string    `json:"pem" bson:"pem"`
+	Algorithm string    `json:"algorithm" bson:"algorithm"`
+	NotBefore time.Time `json:"not_before" bson:"not_before"`
+	NotAfter  time.Time `json:"not_after" bson:"not_after"`
+	Revoked   bool      `json:"revoked" bson:"revoked"`
+}
+
+// SigningKeyStorage is a data layer for SigningKeys based on MongoDB,
+// analogous to SoftwareImagesStorage.
+type SigningKeyStorage struct {
+	session *mgo.Session
+}
+
+// NewSigningKeyStorage new data layer object
+func NewSigningKeyStorage(session *mgo.Session) *SigningKeyStorage {
+
+	return &SigningKeyStorage{
+		session: session,
+	}
+}
+
+// IndexStorage set required indexes.
+// * Set unique index on key ID.
+func (k *SigningKeyStorage) IndexStorage() error {
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	uniqueKeyIDIndex := mgo.Index{
+		Key:        []string{StorageKeySigningKeyID},
+		Unique:     true,
+		Name:       IndexUniqueSigningKeyIDStr,
+		Background: false,
+	}
+
+	return session.DB(DatabaseName).C(CollectionSigningKeys).EnsureIndex(uniqueKeyIDIndex)
+}
+
+// Insert persists a signing key.
+func (k *SigningKeyStorage) Insert(key *SigningKey) error {
+
+	if key == nil || govalidator.IsNull(key.KeyID) {
+		return ErrStorageInvalidSigningKey
+	}
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	return session.DB(DatabaseName).C(CollectionSigningKeys).Insert(key)
+}
+
+// FindByID search storage for a signing key with KeyID, returns nil if
+// not found.
+func (k *SigningKeyStorage) FindByID(keyID string) (*SigningKey, error) {
+
+	if govalidator.IsNull(keyID) {
+		return nil, ErrStorageInvalidSigningKey
+	}
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	var key SigningKey
+	err := session.DB(DatabaseName).C(CollectionSigningKeys).Find(bson.M{StorageKeySigningKeyID: keyID}).One(&key)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// FindAll lists all signing keys.
+func (k *SigningKeyStorage) FindAll() ([]*SigningKey, error) {
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	var keys []*SigningKey
+	err := session.DB(DatabaseName).C(CollectionSigningKeys).Find(nil).All(&keys)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return keys, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Update persists changes to a signing key, e.g. setting Revoked. Return
+// false if not found.
+func (k *SigningKeyStorage) Update(key *SigningKey) (bool, error) {
+
+	if key == nil || govalidator.IsNull(key.KeyID) {
+		return false, ErrStorageInvalidSigningKey
+	}
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	err := session.DB(DatabaseName).C(CollectionSigningKeys).Update(bson.M{StorageKeySigningKeyID: key.KeyID}, key)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Delete removes a signing key specified by KeyID. Noop if not found.
+func (k *SigningKeyStorage) Delete(keyID string) error {
+
+	if govalidator.IsNull(keyID) {
+		return ErrStorageInvalidSigningKey
+	}
+
+	session := k.session.Copy()
+	defer session.Close()
+
+	err := session.DB(DatabaseName).C(CollectionSigningKeys).Remove(bson.M{StorageKeySigningKeyID: keyID})
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil
+	}
+
+	return err
+}
+
+// RequireSignatures toggles whether Insert rejects images that carry no
+// Signatures. Defaults to false.
+func (i *SoftwareImagesStorage) RequireSignatures(require bool) {
+	i.requireSignatures = require
+}
+
+// RegisterVerifier adds v to the set of verifiers VerifyStored runs an
+// image's blob through. VerifyStored succeeds if any registered
+// verifier accepts the image.
+func (i *SoftwareImagesStorage) RegisterVerifier(v Verifier) {
+	i.verifiers = append(i.verifiers, v)
+}
+
+// SetBlobStorage configures the blob store VerifyStored re-streams
+// image content from.
+func (i *SoftwareImagesStorage) SetBlobStorage(blobs BlobStorage) {
+	i.blobs = blobs
+}
+
+// VerifyStored re-streams the blob of the image with the given ID
+// through every verifier registered via RegisterVerifier, succeeding as
+// soon as one of them accepts it.
+func (i *SoftwareImagesStorage) VerifyStored(id string) error {
+
+	image, err := i.FindByID(id)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return ErrStorageInvalidID
+	}
+
+	if len(image.Signatures) == 0 {
+		return ErrStorageUnsignedImage
+	}
+
+	if i.blobs == nil {
+		return errors.New("no blob storage configured")
+	}
+
+	for _, verifier := range i.verifiers {
+		payload, err := i.blobs.Get(context.Background(), id)
+		if err != nil {
+			return err
+		}
+
+		verifyErr := verifier.Verify(image, payload)
+		payload.Close()
+
+		if verifyErr == nil {
+			return nil
+		}
+	}
+
+	return ErrStorageSignatureRejected
+}
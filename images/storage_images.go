@@ -54,25 +54,59 @@ var (
 // SoftwareImagesStorage is a data layer for SoftwareImages based on MongoDB
 type SoftwareImagesStorage struct {
 	session *mgo.Session
+
+	// allowLegacyVersions lets images whose version is not valid semver
+	// be inserted/updated without a parsed semver.{major,minor,patch}
+	// side record. Such images can still be found through
+	// FindByID/FindAll, but are excluded from
+	// FindLatestByApplicationAndModel. Defaults to true so existing,
+	// pre-semver data keeps inserting/updating the way it always has;
+	// callers that want to enforce semver versions going forward opt in
+	// with AllowLegacyVersions(false).
+	allowLegacyVersions bool
+
+	// requireSignatures rejects Insert of images with no Signatures.
+	requireSignatures bool
+
+	// verifiers and blobs back VerifyStored; both are only required
+	// when VerifyStored is actually used.
+	verifiers []Verifier
+	blobs     BlobStorage
+
+	// deltaGenerator backs EnsureDelta; only required when EnsureDelta is
+	// actually used.
+	deltaGenerator *DeltaGenerator
 }
 
 // NewSoftwareImagesStorage new data layer object
 func NewSoftwareImagesStorage(session *mgo.Session) *SoftwareImagesStorage {
 
 	return &SoftwareImagesStorage{
-		session: session,
+		session:             session,
+		allowLegacyVersions: true,
 	}
 }
 
+// AllowLegacyVersions toggles whether images with a non-semver version
+// may be inserted/updated. Defaults to true, so pre-existing data with
+// non-semver versions is unaffected; pass false to require semver going
+// forward.
+func (i *SoftwareImagesStorage) AllowLegacyVersions(allow bool) {
+	i.allowLegacyVersions = allow
+}
+
 // IndexStorage set required indexes.
-// * Set unique index on name-model image keys.
+// * Set unique index on name-model-version image keys, so several
+//   versions of the same application/model can coexist (required for
+//   FindLatestByApplicationAndModel to have more than one candidate to
+//   pick a latest from) while still rejecting an exact duplicate.
 func (i *SoftwareImagesStorage) IndexStorage() error {
 
 	session := i.session.Copy()
 	defer session.Close()
 
 	uniqueNameVersionIndex := mgo.Index{
-		Key:    []string{StorageKeySoftwareImageName, StorageKeySoftwareImageModel},
+		Key:    []string{StorageKeySoftwareImageName, StorageKeySoftwareImageModel, StorageKeySoftwareImageVersion},
 		Unique: true,
 		Name:   IndexUniqeNameVersionStr,
 		// Build index upfront - make sure this index is allways on.
@@ -122,7 +156,13 @@ func (i *SoftwareImagesStorage) Update(image *SoftwareImage) (bool, error) {
 	defer session.Close()
 
 	image.SetModified(time.Now())
-	err := session.DB(DatabaseName).C(CollectionImages).UpdateId(*image.Id, image)
+
+	doc, err := i.withSemver(image)
+	if err != nil {
+		return false, err
+	}
+
+	err = session.DB(DatabaseName).C(CollectionImages).UpdateId(*image.Id, doc)
 
 	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
 		return false, nil
@@ -183,10 +223,19 @@ func (i *SoftwareImagesStorage) Insert(image *SoftwareImage) error {
 		return err
 	}
 
+	if i.requireSignatures && len(image.Signatures) == 0 {
+		return ErrStorageUnsignedImage
+	}
+
 	session := i.session.Copy()
 	defer session.Close()
 
-	if err := session.DB(DatabaseName).C(CollectionImages).Insert(image); err != nil {
+	doc, err := i.withSemver(image)
+	if err != nil {
+		return err
+	}
+
+	if err := session.DB(DatabaseName).C(CollectionImages).Insert(doc); err != nil {
 		return err
 	}
 
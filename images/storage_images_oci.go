@@ -0,0 +1,364 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package images
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ArtifactTypeMenderImage marks a Mender software image artifact, so
+// registries and tooling can tell it apart from a container image.
+// PutArtifact sets it as the manifest's mediaType; the manifest carries
+// no separate artifactType field.
+const ArtifactTypeMenderImage = "application/vnd.mender.image.v1"
+
+// imageConfigLabel is the config-blob label PutArtifact stores a
+// JSON-encoded SoftwareImage under, and PullFromRegistry reads it back
+// from. The raw image content itself is the artifact's single layer.
+const imageConfigLabel = "mender.image.config"
+
+// Database KEYS
+const (
+	// StorageKeySoftwareImageRegistryRef is set on images pushed via
+	// InsertWithRegistry, so FindByReference/DeleteByReference can
+	// resolve a registry reference to the Mongo record that tracks it
+	// without re-pulling and re-importing the artifact.
+	StorageKeySoftwareImageRegistryRef = "softwareimageconstructor.registryref"
+)
+
+// Errors
+var (
+	ErrStorageInvalidReference = errors.New("Invalid registry reference")
+	ErrStorageArtifactNotFound = errors.New("Artifact not found in registry")
+)
+
+// ImageBlobStore persists the raw bytes of a SoftwareImage somewhere
+// other than the existing Mongo+blob store, keyed by content digest
+// rather than ObjectID.
+type ImageBlobStore interface {
+	// PutArtifact packages payload as a single-layer OCI artifact
+	// carrying image's metadata and returns its content digest.
+	PutArtifact(ctx context.Context, image *SoftwareImage, payload io.Reader) (digest string, err error)
+
+	// GetArtifact streams back the layer payload previously stored
+	// under digest.
+	GetArtifact(ctx context.Context, digest string) (io.ReadCloser, error)
+}
+
+// OCIRegistryBlobStore is an ImageBlobStore backed by a container
+// registry, reusing the registry infrastructure operators already run
+// for containers as the content-addressable store for firmware images.
+type OCIRegistryBlobStore struct {
+	// repo is the registry/repository artifacts are pushed to, e.g.
+	// "registry.example.com/mender/images". A digest is appended to
+	// address a specific artifact.
+	repo     string
+	keychain authn.Keychain
+}
+
+// NewOCIRegistryBlobStore creates a blob store that pushes/pulls
+// artifacts under repo using keychain for registry authentication. A nil
+// keychain falls back to authn.DefaultKeychain, same as `docker pull`.
+func NewOCIRegistryBlobStore(repo string, keychain authn.Keychain) *OCIRegistryBlobStore {
+
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+
+	return &OCIRegistryBlobStore{
+		repo:     repo,
+		keychain: keychain,
+	}
+}
+
+// PutArtifact packages payload as a single-layer OCI artifact with
+// manifest mediaType ArtifactTypeMenderImage and image's metadata stored
+// in the config blob under imageConfigLabel, then pushes it to repo.
+func (s *OCIRegistryBlobStore) PutArtifact(ctx context.Context, image *SoftwareImage, payload io.Reader) (string, error) {
+
+	if image == nil {
+		return "", ErrStorageInvalidImage
+	}
+
+	content, err := io.ReadAll(payload)
+	if err != nil {
+		return "", err
+	}
+
+	config, err := json.Marshal(image)
+	if err != nil {
+		return "", err
+	}
+
+	img := mutate.MediaType(empty.Image, ArtifactTypeMenderImage)
+	img = mutate.ConfigMediaType(img, "application/vnd.mender.image.config.v1+json")
+
+	img, err = mutate.Append(img, mutate.Addendum{
+		Layer: static.NewLayer(content, "application/vnd.mender.image.layer.v1"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	img, err = mutate.ConfigFile(img, &v1.ConfigFile{Config: v1.Config{Labels: map[string]string{
+		imageConfigLabel: string(config),
+	}}})
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := name.ParseReference(s.repo + "@" + digest.String())
+	if err != nil {
+		return "", ErrStorageInvalidReference
+	}
+
+	if err := remote.Write(ref, img, remote.WithContext(ctx), remote.WithAuthFromKeychain(s.keychain)); err != nil {
+		return "", err
+	}
+
+	return digest.String(), nil
+}
+
+// GetArtifact pulls the artifact addressed by digest from repo and
+// returns its single layer payload.
+func (s *OCIRegistryBlobStore) GetArtifact(ctx context.Context, digest string) (io.ReadCloser, error) {
+
+	ref, err := name.ParseReference(s.repo + "@" + digest)
+	if err != nil {
+		return nil, ErrStorageInvalidReference
+	}
+
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(s.keychain))
+	if err != nil {
+		return nil, ErrStorageArtifactNotFound
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(layers) == 0 {
+		return nil, ErrStorageArtifactNotFound
+	}
+
+	return layers[0].Uncompressed()
+}
+
+// isRegistryReference reports whether id looks like a registry
+// reference ("registry/repo@sha256:...") rather than a Mongo ObjectID,
+// so callers can dispatch FindByID/Delete/Insert to the right backend.
+func isRegistryReference(id string) bool {
+	return strings.Contains(id, "@sha256:")
+}
+
+// metadata pulls the artifact addressed by digest from repo and decodes
+// the SoftwareImage stored in its config blob - the counterpart to
+// GetArtifact, which returns the raw layer payload instead.
+func (s *OCIRegistryBlobStore) metadata(ctx context.Context, digest string) (*SoftwareImage, error) {
+
+	ref, err := name.ParseReference(s.repo + "@" + digest)
+	if err != nil {
+		return nil, ErrStorageInvalidReference
+	}
+
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(s.keychain))
+	if err != nil {
+		return nil, ErrStorageArtifactNotFound
+	}
+
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, ok := cfg.Config.Labels[imageConfigLabel]
+	if !ok {
+		return nil, ErrStorageArtifactNotFound
+	}
+
+	var image SoftwareImage
+	if err := json.Unmarshal([]byte(encoded), &image); err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// InsertWithRegistry pushes payload to store as an OCI artifact carrying
+// image's metadata, same as PutArtifact, and persists image to Mongo the
+// same way Insert does, recording the resulting registry reference so
+// FindByReference/DeleteByReference can resolve it without re-pulling
+// the artifact. Returns the registry reference.
+func (i *SoftwareImagesStorage) InsertWithRegistry(ctx context.Context, store *OCIRegistryBlobStore, image *SoftwareImage, payload io.Reader) (string, error) {
+
+	if image == nil {
+		return "", ErrStorageInvalidImage
+	}
+
+	if err := image.Validate(); err != nil {
+		return "", err
+	}
+
+	if i.requireSignatures && len(image.Signatures) == 0 {
+		return "", ErrStorageUnsignedImage
+	}
+
+	digest, err := store.PutArtifact(ctx, image, payload)
+	if err != nil {
+		return "", err
+	}
+
+	ref := store.repo + "@" + digest
+
+	doc, err := i.withSemver(image)
+	if err != nil {
+		return "", err
+	}
+	doc[StorageKeySoftwareImageRegistryRef] = ref
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	if err := session.DB(DatabaseName).C(CollectionImages).Insert(doc); err != nil {
+		return "", err
+	}
+
+	return ref, nil
+}
+
+// PullFromRegistry imports an existing OCI artifact addressed by ref
+// (e.g. "registry.example.com/mender/images@sha256:...") into the
+// deployments service: the artifact's config blob is decoded back into
+// a SoftwareImage, validated and persisted to Mongo the same way Insert
+// does, tagged with ref so later lookups resolve it without re-importing.
+func (i *SoftwareImagesStorage) PullFromRegistry(ctx context.Context, store *OCIRegistryBlobStore, ref string) (*SoftwareImage, error) {
+
+	if !isRegistryReference(ref) {
+		return nil, ErrStorageInvalidReference
+	}
+
+	idx := strings.LastIndex(ref, "@")
+	digest := ref[idx+1:]
+
+	image, err := store.metadata(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := image.Validate(); err != nil {
+		return nil, err
+	}
+
+	if i.requireSignatures && len(image.Signatures) == 0 {
+		return nil, ErrStorageUnsignedImage
+	}
+
+	doc, err := i.withSemver(image)
+	if err != nil {
+		return nil, err
+	}
+	doc[StorageKeySoftwareImageRegistryRef] = ref
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	if err := session.DB(DatabaseName).C(CollectionImages).Insert(doc); err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// findByRegistryRef looks up the Mongo record previously imported from,
+// or pushed to, registry reference ref. Returns nil, nil if none is
+// tracked yet.
+func (i *SoftwareImagesStorage) findByRegistryRef(ref string) (*SoftwareImage, error) {
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	var image SoftwareImage
+	err := session.DB(DatabaseName).C(CollectionImages).
+		Find(bson.M{StorageKeySoftwareImageRegistryRef: ref}).One(&image)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// FindByReference resolves id the same way FindByID does, except that a
+// registry reference ("registry/repo@sha256:...") is resolved against
+// the record tracking it, importing it from store on first sight.
+func (i *SoftwareImagesStorage) FindByReference(ctx context.Context, store *OCIRegistryBlobStore, id string) (*SoftwareImage, error) {
+
+	if !isRegistryReference(id) {
+		return i.FindByID(id)
+	}
+
+	if image, err := i.findByRegistryRef(id); err != nil || image != nil {
+		return image, err
+	}
+
+	return i.PullFromRegistry(ctx, store, id)
+}
+
+// DeleteByReference resolves id the same way Delete does, except that a
+// registry reference is resolved against the record tracking it instead
+// of a Mongo ObjectID. It never pulls from the registry: if id has not
+// been imported or pushed yet, there is nothing to delete. The artifact
+// itself is left in the registry, which remains the source of truth for
+// it.
+func (i *SoftwareImagesStorage) DeleteByReference(id string) error {
+
+	if !isRegistryReference(id) {
+		return i.Delete(id)
+	}
+
+	image, err := i.findByRegistryRef(id)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return nil
+	}
+
+	return i.Delete(*image.Id)
+}
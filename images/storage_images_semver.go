@@ -0,0 +1,257 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package images
+
+import (
+	"sort"
+
+	"github.com/Masterminds/semver"
+	"github.com/asaskevich/govalidator"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Database KEYS
+const (
+	// Raw, application supplied version string - kept for the legacy
+	// lexicographic lookup path and for images whose version is not
+	// valid semver.
+	StorageKeySoftwareImageVersion = "softwareimageconstructor.version"
+
+	// Parsed semver components, populated by Insert/Update whenever the
+	// version string is valid semver. Indexed so Mongo can answer
+	// "latest matching constraint" queries without a full collection
+	// scan.
+	StorageKeySoftwareImageSemverMajor       = "softwareimageconstructor.semver.major"
+	StorageKeySoftwareImageSemverMinor       = "softwareimageconstructor.semver.minor"
+	StorageKeySoftwareImageSemverPatch       = "softwareimageconstructor.semver.patch"
+	StorageKeySoftwareImageSemverPrerelease  = "softwareimageconstructor.semver.prerelease"
+)
+
+// Indexes
+const (
+	IndexAppModelSemverStr = "appModelSemverIndex"
+)
+
+// IndexSemverStorage sets the compound index used by the semver range
+// queries below. Separate from IndexStorage so callers that only need
+// the legacy lookup path are not forced to build it.
+func (i *SoftwareImagesStorage) IndexSemverStorage() error {
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	appModelSemverIndex := mgo.Index{
+		Key: []string{
+			StorageKeySoftwareImageModel,
+			StorageKeySoftwareImageName,
+			StorageKeySoftwareImageSemverMajor,
+			StorageKeySoftwareImageSemverMinor,
+			StorageKeySoftwareImageSemverPatch,
+		},
+		Unique:     false,
+		Name:       IndexAppModelSemverStr,
+		Background: false,
+	}
+
+	return session.DB(DatabaseName).C(CollectionImages).EnsureIndex(appModelSemverIndex)
+}
+
+// softwareImageConstructorKey is the top-level bson key the
+// SoftwareImage fields referenced by the dotted StorageKeySoftwareImage*
+// constants actually marshal under - those constants are Mongo query/
+// projection paths, not literal document keys, so code that builds or
+// reads a bson.M produced by bson.Marshal/Unmarshal has to go through
+// this nested sub-document instead of indexing the dotted string
+// directly.
+const softwareImageConstructorKey = "softwareimageconstructor"
+
+// constructorDoc returns the nested softwareimageconstructor sub-document
+// of doc, creating it if absent.
+func constructorDoc(doc bson.M) bson.M {
+	constructor, _ := doc[softwareImageConstructorKey].(bson.M)
+	if constructor == nil {
+		constructor = bson.M{}
+		doc[softwareImageConstructorKey] = constructor
+	}
+	return constructor
+}
+
+// withSemver marshals image to its Mongo document and, when its version
+// field is valid semver, merges in the parsed major/minor/patch/
+// prerelease fields used by FindLatestByApplicationAndModel. The app
+// identity (name) is left untouched - it is shared by every version of
+// the same application, which is exactly what lets several versions of
+// one app/model coexist. Images whose version is not valid semver are
+// rejected with ErrStorageInvalidVersion after AllowLegacyVersions(false);
+// otherwise (the default) they are stored with the raw version only and
+// are only reachable through the legacy lexicographic path.
+func (i *SoftwareImagesStorage) withSemver(image *SoftwareImage) (bson.M, error) {
+
+	raw, err := bson.Marshal(image)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc bson.M
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+
+	constructor := constructorDoc(doc)
+	version, _ := constructor["version"].(string)
+
+	parsed, err := semver.NewVersion(version)
+	if err != nil {
+		if i.allowLegacyVersions {
+			return doc, nil
+		}
+		return nil, ErrStorageInvalidVersion
+	}
+
+	constructor["semver"] = bson.M{
+		"major":      parsed.Major(),
+		"minor":      parsed.Minor(),
+		"patch":      parsed.Patch(),
+		"prerelease": parsed.Prerelease(),
+	}
+
+	return doc, nil
+}
+
+// FindLatestByApplicationAndModel returns the highest SoftwareImage for
+// app/model whose version satisfies constraint (npm-style, e.g. "^1.2.0",
+// ">=2.0.0 <3.0.0"). Returns nil, nil if no version satisfies it.
+func (i *SoftwareImagesStorage) FindLatestByApplicationAndModel(app, model, constraint string) (*SoftwareImage, error) {
+
+	if govalidator.IsNull(app) {
+		return nil, ErrStorageInvalidImage
+	}
+
+	if govalidator.IsNull(model) {
+		return nil, ErrStorageInvalidModel
+	}
+
+	constr, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, ErrStorageInvalidVersion
+	}
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	query := bson.M{
+		StorageKeySoftwareImageName:  app,
+		StorageKeySoftwareImageModel: model,
+	}
+
+	var candidates []bson.M
+	err = session.DB(DatabaseName).C(CollectionImages).Find(query).
+		Select(bson.M{StorageKeySoftwareImageId: 1, StorageKeySoftwareImageVersion: 1}).All(&candidates)
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var latestID interface{}
+	var latestVersion *semver.Version
+	for _, candidate := range candidates {
+		raw, _ := constructorDoc(candidate)["version"].(string)
+		version, err := semver.NewVersion(raw)
+		if err != nil {
+			// Not valid semver - only reachable through the legacy
+			// lexicographic path, skip it here.
+			continue
+		}
+
+		if !constr.Check(version) {
+			continue
+		}
+
+		if latestVersion == nil || version.GreaterThan(latestVersion) {
+			latestID = candidate[StorageKeySoftwareImageId]
+			latestVersion = version
+		}
+	}
+
+	if latestID == nil {
+		return nil, nil
+	}
+
+	var latest SoftwareImage
+	if err := session.DB(DatabaseName).C(CollectionImages).FindId(latestID).One(&latest); err != nil {
+		return nil, err
+	}
+
+	return &latest, nil
+}
+
+// ListVersionsByApplication returns every known version of app on model,
+// sorted ascending by semver precedence. Versions that are not valid
+// semver are appended at the end, sorted lexicographically, so that
+// images predating this feature are still listed.
+func (i *SoftwareImagesStorage) ListVersionsByApplication(app, model string) ([]string, error) {
+
+	if govalidator.IsNull(app) {
+		return nil, ErrStorageInvalidImage
+	}
+
+	if govalidator.IsNull(model) {
+		return nil, ErrStorageInvalidModel
+	}
+
+	session := i.session.Copy()
+	defer session.Close()
+
+	query := bson.M{
+		StorageKeySoftwareImageName:  app,
+		StorageKeySoftwareImageModel: model,
+	}
+
+	var candidates []bson.M
+	err := session.DB(DatabaseName).C(CollectionImages).Find(query).
+		Select(bson.M{StorageKeySoftwareImageVersion: 1}).All(&candidates)
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var semverVersions []*semver.Version
+	var legacyVersions []string
+
+	for _, candidate := range candidates {
+		raw, _ := constructorDoc(candidate)["version"].(string)
+		if parsed, err := semver.NewVersion(raw); err == nil {
+			semverVersions = append(semverVersions, parsed)
+		} else {
+			legacyVersions = append(legacyVersions, raw)
+		}
+	}
+
+	sort.Sort(semver.Collection(semverVersions))
+	sort.Strings(legacyVersions)
+
+	versions := make([]string, 0, len(semverVersions)+len(legacyVersions))
+	for _, v := range semverVersions {
+		versions = append(versions, v.Original())
+	}
+	versions = append(versions, legacyVersions...)
+
+	return versions, nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2016 Mender Software AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package images
+
+import (
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WildcardModel is the ManifestEntry.Model value used as a fallback for
+// any device model not otherwise listed in the manifest.
+const WildcardModel = "*"
+
+// Database
+const (
+	CollectionManifests = "manifests"
+)
+
+// Database KEYS
+const (
+	StorageKeyManifestID   = "_id"
+	StorageKeyManifestName = "name"
+)
+
+// Indexes
+const (
+	IndexManifestModelStr = "manifestModelIndex"
+)
+
+// Errors
+var (
+	ErrStorageInvalidManifest     = errors.New("Invalid manifest")
+	ErrStorageInvalidManifestID   = errors.New("Invalid manifest id")
+	ErrStorageNoMatchingEntry     = errors.New("No manifest entry matches device model")
+	ErrStorageDuplicateEntryModel = errors.New("Manifest has more than one entry for the same model")
+)
+
+// ManifestEntry is one model's image within an ImageManifest.
+type ManifestEntry struct {
+	Model   string `json:"model" bson:"model"`
+	ImageID string `json:"image_id" bson:"image_id"`
+	Digest  string `json:"digest" bson:"digest"`
+	Size    int64  `json:"size" bson:"size"`
+}
+
+// ImageManifest groups several SoftwareImage entries, one per device
+// model, under a single logical release name - the manifest-list
+// equivalent of a single SoftwareImage, so one deployment can target a
+// mixed fleet of models with one release.
+type ImageManifest struct {
+	ManifestID string          `json:"manifest_id" bson:"_id"`
+	Name       string          `json:"name" bson:"name"`
+	CreatedAt  time.Time       `json:"created_at" bson:"created_at"`
+	Entries    []ManifestEntry `json:"entries" bson:"entries"`
+}
+
+// ManifestStorage is a data layer for ImageManifests based on MongoDB.
+type ManifestStorage struct {
+	images  *SoftwareImagesStorage
+	session *mgo.Session
+}
+
+// NewManifestStorage new data layer object. images is used by
+// ResolveForDevice to fetch the SoftwareImage an entry points at.
+func NewManifestStorage(session *mgo.Session, images *SoftwareImagesStorage) *ManifestStorage {
+
+	return &ManifestStorage{
+		images:  images,
+		session: session,
+	}
+}
+
+// IndexStorage set required indexes.
+// * Index entries.model, so ResolveForDevice-style lookups by model
+//   don't need a collection scan. Mongo's multikey indexes only enforce
+//   uniqueness of the whole indexed array against other documents, not
+//   among elements within the same document, so this does not (and
+//   cannot) prevent a manifest from carrying two entries for the same
+//   model - Insert checks that instead.
+func (m *ManifestStorage) IndexStorage() error {
+
+	session := m.session.Copy()
+	defer session.Close()
+
+	manifestModelIndex := mgo.Index{
+		Key:        []string{"entries.model"},
+		Unique:     false,
+		Name:       IndexManifestModelStr,
+		Background: false,
+	}
+
+	return session.DB(DatabaseName).C(CollectionManifests).EnsureIndex(manifestModelIndex)
+}
+
+// Insert persists a manifest.
+func (m *ManifestStorage) Insert(manifest *ImageManifest) error {
+
+	if manifest == nil || govalidator.IsNull(manifest.ManifestID) {
+		return ErrStorageInvalidManifest
+	}
+
+	seen := make(map[string]bool, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		if seen[entry.Model] {
+			return ErrStorageDuplicateEntryModel
+		}
+		seen[entry.Model] = true
+	}
+
+	session := m.session.Copy()
+	defer session.Close()
+
+	return session.DB(DatabaseName).C(CollectionManifests).Insert(manifest)
+}
+
+// FindByID search storage for a manifest with ManifestID, returns nil if
+// not found.
+func (m *ManifestStorage) FindByID(manifestID string) (*ImageManifest, error) {
+
+	if govalidator.IsNull(manifestID) {
+		return nil, ErrStorageInvalidManifestID
+	}
+
+	session := m.session.Copy()
+	defer session.Close()
+
+	var manifest ImageManifest
+	err := session.DB(DatabaseName).C(CollectionManifests).FindId(manifestID).One(&manifest)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// FindByName lists every manifest published under name, newest first.
+func (m *ManifestStorage) FindByName(name string) ([]*ImageManifest, error) {
+
+	if govalidator.IsNull(name) {
+		return nil, ErrStorageInvalidManifest
+	}
+
+	session := m.session.Copy()
+	defer session.Close()
+
+	var manifests []*ImageManifest
+	err := session.DB(DatabaseName).C(CollectionManifests).
+		Find(bson.M{StorageKeyManifestName: name}).
+		Sort("-created_at").All(&manifests)
+
+	if err != nil && err.Error() == mgo.ErrNotFound.Error() {
+		return manifests, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return manifests, nil
+}
+
+// ResolveForDevice walks the manifest identified by manifestID and
+// returns the SoftwareImage of the entry matching model, falling back
+// to the WildcardModel entry if model has no entry of its own.
+func (m *ManifestStorage) ResolveForDevice(manifestID, model string) (*SoftwareImage, error) {
+
+	manifest, err := m.FindByID(manifestID)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, ErrStorageInvalidManifestID
+	}
+
+	var imageID string
+	var wildcardImageID string
+
+	for _, entry := range manifest.Entries {
+		if entry.Model == model {
+			imageID = entry.ImageID
+			break
+		}
+		if entry.Model == WildcardModel {
+			wildcardImageID = entry.ImageID
+		}
+	}
+
+	if imageID == "" {
+		imageID = wildcardImageID
+	}
+
+	if imageID == "" {
+		return nil, ErrStorageNoMatchingEntry
+	}
+
+	return m.images.FindByID(imageID)
+}